@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultScrapeInterval = 15 * time.Second
+
+// Collector runs fetchMetrics on a fixed interval in the background and
+// serves the cached result to HTTP handlers, instead of hitting Postgres on
+// every /metrics request. pmetrics.list_metrics() scans internal
+// shared-memory tables that get expensive when a Prometheus HA pair scrapes
+// the same instance twice, so sharing one scrape across all requests matters.
+type Collector struct {
+	db       *sql.DB
+	interval time.Duration
+	sf       singleflight.Group
+
+	mu               sync.RWMutex
+	scraped          bool
+	metrics          []Metric
+	allBuckets       []int
+	nativeHistograms []NativeHistogram
+
+	lastScrapeDuration  float64
+	lastScrapeTimestamp float64
+	scrapeErrors        int64
+	up                  int64
+}
+
+func newCollector(db *sql.DB, interval time.Duration) *Collector {
+	if interval <= 0 {
+		interval = defaultScrapeInterval
+	}
+	return &Collector{db: db, interval: interval}
+}
+
+// run scrapes once immediately, so the first /metrics request doesn't race
+// an empty cache, then keeps refreshing on the configured interval until the
+// process exits. Callers are expected to start it with "go collector.run()".
+func (c *Collector) run() {
+	c.refresh()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.refresh()
+	}
+}
+
+// refresh scrapes Postgres and updates the cache. Concurrent callers (the
+// background ticker and a request hitting a cold cache) coalesce to a single
+// DB round-trip via singleflight. Native histograms are fetched in the same
+// pass so the protobuf exposition path can be served from cache too, instead
+// of querying pmetrics.list_native_histograms() on every scrape.
+func (c *Collector) refresh() {
+	_, err, _ := c.sf.Do("scrape", func() (interface{}, error) {
+		start := time.Now()
+		metrics, allBuckets, fetchErr := fetchMetrics(c.db)
+
+		var nativeHistograms []NativeHistogram
+		var nhErr error
+		if fetchErr == nil {
+			nativeHistograms, nhErr = fetchNativeHistograms(c.db)
+		}
+		duration := time.Since(start).Seconds()
+
+		c.mu.Lock()
+		c.lastScrapeDuration = duration
+		c.lastScrapeTimestamp = float64(time.Now().Unix())
+		if fetchErr == nil {
+			c.metrics = metrics
+			c.allBuckets = allBuckets
+			c.scraped = true
+		}
+		if fetchErr == nil && nhErr == nil {
+			c.nativeHistograms = nativeHistograms
+		}
+		c.mu.Unlock()
+
+		if fetchErr != nil {
+			atomic.AddInt64(&c.scrapeErrors, 1)
+			atomic.StoreInt64(&c.up, 0)
+			return nil, fetchErr
+		}
+		if nhErr != nil {
+			atomic.AddInt64(&c.scrapeErrors, 1)
+			log.Printf("collector: failed to fetch native histograms: %v", nhErr)
+		}
+		atomic.StoreInt64(&c.up, 1)
+		return nil, nil
+	})
+
+	if err != nil {
+		log.Printf("collector: scrape failed: %v", err)
+	}
+}
+
+// Get returns the cached metrics, scraping synchronously on a cold cache
+// (e.g. the first request racing the background goroutine's initial scrape).
+func (c *Collector) Get() ([]Metric, []int) {
+	c.mu.RLock()
+	scraped := c.scraped
+	c.mu.RUnlock()
+
+	if !scraped {
+		c.refresh()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.metrics, c.allBuckets
+}
+
+// GetNativeHistograms returns the cached native histograms for the protobuf
+// exposition path, scraping synchronously on a cold cache just like Get.
+func (c *Collector) GetNativeHistograms() []NativeHistogram {
+	c.mu.RLock()
+	scraped := c.scraped
+	c.mu.RUnlock()
+
+	if !scraped {
+		c.refresh()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nativeHistograms
+}
+
+// selfMetric is one self-observability gauge/counter, named without the
+// "_total" suffix even for counters: Prometheus text format and OpenMetrics
+// disagree on whether that suffix belongs on the family name or only on the
+// sample, so each renderer below applies it where that format expects it.
+type selfMetric struct {
+	name  string
+	help  string
+	typ   string
+	value float64
+}
+
+// selfMetrics reports how the last scrape of pmetrics.list_metrics() went:
+// duration, error count, last scrape time and an up gauge. These bypass the
+// normal []Metric/formatMetrics path since their values are fractional
+// seconds, not the int64 counts pmetrics.list_metrics() deals in.
+func (c *Collector) selfMetrics() []selfMetric {
+	c.mu.RLock()
+	duration := c.lastScrapeDuration
+	timestamp := c.lastScrapeTimestamp
+	c.mu.RUnlock()
+
+	errors := atomic.LoadInt64(&c.scrapeErrors)
+	up := atomic.LoadInt64(&c.up)
+
+	return []selfMetric{
+		{"pmetrics_scrape_duration_seconds", "Duration of the last scrape of pmetrics.list_metrics() in seconds.", "gauge", duration},
+		{"pmetrics_scrape_errors", "Total number of scrapes that failed to fetch metrics from Postgres.", "counter", float64(errors)},
+		{"pmetrics_last_scrape_timestamp_seconds", "Unix timestamp of the last scrape attempt.", "gauge", timestamp},
+		{"pmetrics_up", "Whether the last scrape of pmetrics.list_metrics() succeeded.", "gauge", float64(up)},
+	}
+}
+
+// selfMetricsText renders self-observability metrics in classic Prometheus
+// text format, where a counter's family name and sample name are the same
+// "_total"-suffixed identifier.
+func (c *Collector) selfMetricsText() string {
+	var lines []string
+	for _, m := range c.selfMetrics() {
+		name := m.name
+		if m.typ == "counter" {
+			name += "_total"
+		}
+		lines = append(lines, fmt.Sprintf("# HELP %s %s", name, m.help))
+		lines = append(lines, fmt.Sprintf("# TYPE %s %s", name, m.typ))
+		lines = append(lines, fmt.Sprintf("%s %g", name, m.value))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// selfMetricsOpenMetricsText renders the same values in OpenMetrics 1.0
+// format, where the family name stays bare and only the sample carries the
+// "_total" suffix.
+func (c *Collector) selfMetricsOpenMetricsText() string {
+	var lines []string
+	for _, m := range c.selfMetrics() {
+		lines = append(lines, fmt.Sprintf("# HELP %s %s", m.name, m.help))
+		lines = append(lines, fmt.Sprintf("# TYPE %s %s", m.name, m.typ))
+
+		sampleName := m.name
+		if m.typ == "counter" {
+			sampleName += "_total"
+		}
+		lines = append(lines, fmt.Sprintf("%s %g", sampleName, m.value))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
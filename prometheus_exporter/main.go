@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -10,7 +11,9 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -20,6 +23,14 @@ var whitespaceRegex = regexp.MustCompile(` +`)
 type Config struct {
 	DatabaseURL string
 	Port        string
+
+	RemoteWriteURL         string
+	RemoteWriteInterval    time.Duration
+	RemoteWriteUsername    string
+	RemoteWritePassword    string
+	RemoteWriteBearerToken string
+
+	ScrapeInterval time.Duration
 }
 
 type Metric struct {
@@ -29,6 +40,18 @@ type Metric struct {
 	Bucket    int
 	Value     int64
 	QueryText sql.NullString
+	Help      sql.NullString
+	Unit      sql.NullString
+	CreatedAt sql.NullFloat64
+	Exemplars []Exemplar
+}
+
+// Exemplar is a trace-to-metric correlation attached to a histogram bucket,
+// sourced from the exemplars JSON column of pmetrics.list_metrics().
+type Exemplar struct {
+	Labels    map[string]interface{} `json:"labels"`
+	Value     float64                `json:"value"`
+	Timestamp float64                `json:"timestamp"`
 }
 
 func loadConfig() (*Config, error) {
@@ -42,9 +65,35 @@ func loadConfig() (*Config, error) {
 		port = "9187"
 	}
 
+	remoteWriteInterval := 15 * time.Second
+	if v := os.Getenv("REMOTE_WRITE_INTERVAL_SECONDS"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REMOTE_WRITE_INTERVAL_SECONDS: %w", err)
+		}
+		remoteWriteInterval = time.Duration(seconds) * time.Second
+	}
+
+	scrapeInterval := defaultScrapeInterval
+	if v := os.Getenv("SCRAPE_INTERVAL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SCRAPE_INTERVAL: %w", err)
+		}
+		scrapeInterval = parsed
+	}
+
 	return &Config{
 		DatabaseURL: dbURL,
 		Port:        port,
+
+		RemoteWriteURL:         os.Getenv("REMOTE_WRITE_URL"),
+		RemoteWriteInterval:    remoteWriteInterval,
+		RemoteWriteUsername:    os.Getenv("REMOTE_WRITE_USERNAME"),
+		RemoteWritePassword:    os.Getenv("REMOTE_WRITE_PASSWORD"),
+		RemoteWriteBearerToken: os.Getenv("REMOTE_WRITE_BEARER_TOKEN"),
+
+		ScrapeInterval: scrapeInterval,
 	}, nil
 }
 
@@ -116,7 +165,11 @@ func fetchMetrics(db *sql.DB) ([]Metric, []int, error) {
 			m.type,
 			m.bucket,
 			m.value,
-			q.query_text
+			q.query_text,
+			m.help,
+			m.unit,
+			m.created_at,
+			m.exemplars
 		FROM pmetrics.list_metrics() m
 		LEFT JOIN pmetrics_stmts.list_queries() q
 			ON (m.labels->>'queryid')::bigint = q.queryid
@@ -133,8 +186,9 @@ func fetchMetrics(db *sql.DB) ([]Metric, []int, error) {
 	for rows.Next() {
 		var m Metric
 		var labelsJSON []byte
+		var exemplarsJSON []byte
 
-		if err := rows.Scan(&m.Name, &labelsJSON, &m.Type, &m.Bucket, &m.Value, &m.QueryText); err != nil {
+		if err := rows.Scan(&m.Name, &labelsJSON, &m.Type, &m.Bucket, &m.Value, &m.QueryText, &m.Help, &m.Unit, &m.CreatedAt, &exemplarsJSON); err != nil {
 			return nil, nil, fmt.Errorf("failed to scan metric: %w", err)
 		}
 
@@ -149,6 +203,12 @@ func fetchMetrics(db *sql.DB) ([]Metric, []int, error) {
 			m.Labels = make(map[string]interface{})
 		}
 
+		if len(exemplarsJSON) > 0 {
+			if err := json.Unmarshal(exemplarsJSON, &m.Exemplars); err != nil {
+				return nil, nil, fmt.Errorf("failed to parse exemplars: %w", err)
+			}
+		}
+
 		if m.QueryText.Valid && m.QueryText.String != "" {
 			compacted := compactQuery(m.QueryText.String)
 			// Truncate to fit Prometheus label size limits
@@ -168,118 +228,196 @@ func fetchMetrics(db *sql.DB) ([]Metric, []int, error) {
 	return metrics, allBuckets, nil
 }
 
-// formatMetrics converts pmetrics data to Prometheus text exposition format.
-// Histograms are converted to cumulative buckets as required by Prometheus spec.
-func formatMetrics(metrics []Metric, allBuckets []int) string {
-	var lines []string
-	emittedTypes := make(map[string]bool)
+// metricGroup accumulates every series for one metric name so formatMetrics
+// can emit a single TYPE block per name with all of its series contiguous,
+// regardless of the order rows arrived in from fetchMetrics.
+type metricGroup struct {
+	typ  string
+	help string
+	unit string
+
+	simpleByLabel    map[string]Metric
+	simpleLabelOrder []string
+
+	histBuckets    map[string]map[int]int64
+	histSums       map[string]int64
+	histLabels     map[string]map[string]interface{}
+	histLabelOrder []string
+	histExemplars  map[string]map[int][]Exemplar
+	histCreated    map[string]float64
+}
 
-	histograms := make(map[string]map[int]int64)
-	histogramSums := make(map[string]int64)
-	histogramLabels := make(map[string]map[string]interface{})
-	var simpleMetrics []Metric
+// groupMetricsByName buckets metrics by name and, within a name, by a
+// canonical label string (formatLabels sorts keys, so two labelsets that
+// differ only in map iteration order collapse to the same key). Grouping by
+// name up front, rather than relying on arrival order, is what lets every
+// exposition format stay correct after applyRelabeling's Rename maps two
+// originally distinct, non-contiguous metric names onto the same target
+// name.
+func groupMetricsByName(metrics []Metric) map[string]*metricGroup {
+	groups := make(map[string]*metricGroup)
+
+	group := func(name string) *metricGroup {
+		g, ok := groups[name]
+		if !ok {
+			g = &metricGroup{
+				simpleByLabel: make(map[string]Metric),
+				histBuckets:   make(map[string]map[int]int64),
+				histSums:      make(map[string]int64),
+				histLabels:    make(map[string]map[string]interface{}),
+				histExemplars: make(map[string]map[int][]Exemplar),
+				histCreated:   make(map[string]float64),
+			}
+			groups[name] = g
+		}
+		return g
+	}
 
 	for _, m := range metrics {
-		if m.Type == "histogram" {
-			labelsJSON, err := json.Marshal(m.Labels)
-			if err != nil {
-				continue
-			}
-			key := m.Name + string(labelsJSON)
+		g := group(m.Name)
+		key := formatLabels(m.Labels)
+
+		if g.help == "" && m.Help.Valid {
+			g.help = m.Help.String
+		}
+		if g.unit == "" && m.Unit.Valid {
+			g.unit = m.Unit.String
+		}
 
-			if histograms[key] == nil {
-				histograms[key] = make(map[int]int64)
-				histogramLabels[key] = m.Labels
+		switch m.Type {
+		case "histogram":
+			g.typ = "histogram"
+			if g.histBuckets[key] == nil {
+				g.histBuckets[key] = make(map[int]int64)
+				g.histLabels[key] = m.Labels
+				g.histLabelOrder = append(g.histLabelOrder, key)
 			}
-			histograms[key][m.Bucket] = m.Value
-		} else if m.Type == "histogram_sum" {
-			labelsJSON, err := json.Marshal(m.Labels)
-			if err != nil {
-				continue
+			g.histBuckets[key][m.Bucket] = m.Value
+			if len(m.Exemplars) > 0 {
+				if g.histExemplars[key] == nil {
+					g.histExemplars[key] = make(map[int][]Exemplar)
+				}
+				g.histExemplars[key][m.Bucket] = m.Exemplars
 			}
-			key := m.Name + string(labelsJSON)
-			histogramSums[key] = m.Value
-			histogramLabels[key] = m.Labels
-		} else {
-			simpleMetrics = append(simpleMetrics, m)
+			if m.CreatedAt.Valid {
+				g.histCreated[key] = m.CreatedAt.Float64
+			}
+		case "histogram_sum":
+			g.typ = "histogram"
+			if _, ok := g.histLabels[key]; !ok {
+				g.histLabels[key] = m.Labels
+				g.histLabelOrder = append(g.histLabelOrder, key)
+			}
+			g.histSums[key] = m.Value
+		default:
+			g.typ = m.Type
+			if _, ok := g.simpleByLabel[key]; !ok {
+				g.simpleLabelOrder = append(g.simpleLabelOrder, key)
+			}
+			g.simpleByLabel[key] = m
 		}
 	}
 
-	for _, m := range simpleMetrics {
-		if !emittedTypes[m.Name] {
-			lines = append(lines, fmt.Sprintf("# TYPE %s %s", m.Name, m.Type))
-			emittedTypes[m.Name] = true
-		}
-
-		labelStr := formatLabels(m.Labels)
-		lines = append(lines, fmt.Sprintf("%s%s %d", m.Name, labelStr, m.Value))
+	for _, g := range groups {
+		sort.Strings(g.simpleLabelOrder)
+		sort.Strings(g.histLabelOrder)
 	}
 
-	histogramKeys := make([]string, 0, len(histograms))
-	for key := range histograms {
-		histogramKeys = append(histogramKeys, key)
+	return groups
+}
+
+// formatMetrics converts pmetrics data to Prometheus text exposition format.
+// Histograms are converted to cumulative buckets as required by Prometheus
+// spec. Samples are grouped by metric name up front so each name gets
+// exactly one TYPE line and all of its series are emitted contiguously, in a
+// deterministic order, regardless of arrival order or label map iteration.
+func formatMetrics(metrics []Metric, allBuckets []int) string {
+	groups := groupMetricsByName(metrics)
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
 	}
-	sort.Strings(histogramKeys)
+	sort.Strings(names)
 
-	for _, key := range histogramKeys {
-		bucketValues := histograms[key]
-		labels := histogramLabels[key]
+	var lines []string
+	for _, name := range names {
+		g := groups[name]
+		lines = append(lines, fmt.Sprintf("# TYPE %s %s", name, g.typ))
 
-		labelsJSON, err := json.Marshal(labels)
-		if err != nil {
+		if g.typ == "histogram" {
+			for _, key := range g.histLabelOrder {
+				lines = append(lines, formatHistogramSeries(name, key, g, allBuckets)...)
+			}
 			continue
 		}
-		name := strings.TrimSuffix(key, string(labelsJSON))
 
-		if !emittedTypes[name] {
-			lines = append(lines, fmt.Sprintf("# TYPE %s histogram", name))
-			emittedTypes[name] = true
+		for _, key := range g.simpleLabelOrder {
+			m := g.simpleByLabel[key]
+			lines = append(lines, fmt.Sprintf("%s%s %d", name, key, m.Value))
 		}
+	}
 
-		baseLabelStr := formatLabels(labels)
-
-		var cumulativeCount int64
-		for _, bucketThreshold := range allBuckets {
-			bucketValue := bucketValues[bucketThreshold]
-			cumulativeCount += bucketValue
+	return strings.Join(lines, "\n") + "\n"
+}
 
-			var labelStr string
-			if baseLabelStr != "" {
-				labelStr = baseLabelStr[:len(baseLabelStr)-1] + fmt.Sprintf(`,le="%d"`, bucketThreshold) + "}"
-			} else {
-				labelStr = fmt.Sprintf(`{le="%d"}`, bucketThreshold)
-			}
+// formatHistogramSeries renders the _bucket/_count/_sum series for one
+// labelset of one histogram metric. baseLabelStr is the canonical label
+// string used as the group's key, so it already has curly braces (or is
+// empty for an unlabeled series).
+func formatHistogramSeries(name, baseLabelStr string, g *metricGroup, allBuckets []int) []string {
+	bucketValues := g.histBuckets[baseLabelStr]
 
-			lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, labelStr, cumulativeCount))
-		}
+	var lines []string
+	var cumulativeCount int64
+	for _, bucketThreshold := range allBuckets {
+		cumulativeCount += bucketValues[bucketThreshold]
 
-		var infLabelStr string
+		var labelStr string
 		if baseLabelStr != "" {
-			infLabelStr = baseLabelStr[:len(baseLabelStr)-1] + `,le="+Inf"}`
+			labelStr = baseLabelStr[:len(baseLabelStr)-1] + fmt.Sprintf(`,le="%d"`, bucketThreshold) + "}"
 		} else {
-			infLabelStr = `{le="+Inf"}`
+			labelStr = fmt.Sprintf(`{le="%d"}`, bucketThreshold)
 		}
-		lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, infLabelStr, cumulativeCount))
 
-		lines = append(lines, fmt.Sprintf("%s_count%s %d", name, baseLabelStr, cumulativeCount))
+		lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, labelStr, cumulativeCount))
+	}
 
-		sumValue := histogramSums[key]
-		lines = append(lines, fmt.Sprintf("%s_sum%s %d", name, baseLabelStr, sumValue))
+	var infLabelStr string
+	if baseLabelStr != "" {
+		infLabelStr = baseLabelStr[:len(baseLabelStr)-1] + `,le="+Inf"}`
+	} else {
+		infLabelStr = `{le="+Inf"}`
 	}
+	lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, infLabelStr, cumulativeCount))
+	lines = append(lines, fmt.Sprintf("%s_count%s %d", name, baseLabelStr, cumulativeCount))
+	lines = append(lines, fmt.Sprintf("%s_sum%s %d", name, baseLabelStr, g.histSums[baseLabelStr]))
 
-	return strings.Join(lines, "\n") + "\n"
+	return lines
 }
 
-func metricsHandler(db *sql.DB) http.HandlerFunc {
+func metricsHandler(collector *Collector, relabelCfg *compiledRelabelConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		metrics, allBuckets, err := fetchMetrics(db)
-		if err != nil {
-			log.Printf("Error fetching metrics: %v", err)
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		metrics, allBuckets := collector.Get()
+		metrics = applyRelabeling(metrics, relabelCfg)
+
+		switch negotiateFormat(r) {
+		case "openmetrics":
+			output := formatMetricsOpenMetrics(metrics, allBuckets)
+			output = strings.TrimSuffix(output, "# EOF\n") + collector.selfMetricsOpenMetricsText() + "# EOF\n"
+			w.Header().Set("Content-Type", openMetricsContentType)
+			io.WriteString(w, output)
+			return
+		case "protobuf":
+			nativeHistograms := collector.GetNativeHistograms()
+			w.Header().Set("Content-Type", protobufContentType)
+			if err := writeProtobufMetrics(w, metrics, allBuckets, nativeHistograms); err != nil {
+				log.Printf("Error writing protobuf metrics: %v", err)
+			}
 			return
 		}
 
-		output := formatMetrics(metrics, allBuckets)
+		output := formatMetrics(metrics, allBuckets) + collector.selfMetricsText()
 
 		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 		io.WriteString(w, output)
@@ -287,10 +425,25 @@ func metricsHandler(db *sql.DB) http.HandlerFunc {
 }
 
 func main() {
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote-write endpoint to push scraped metrics to (overrides REMOTE_WRITE_URL)")
+	configPath := flag.String("config", "", "Path to a YAML/JSON relabeling config (rename, drop labels, static labels, allow/deny list)")
+	flag.Parse()
+
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Configuration error: %v", err)
 	}
+	if *remoteWriteURL != "" {
+		config.RemoteWriteURL = *remoteWriteURL
+	}
+
+	var relabelCfg *compiledRelabelConfig
+	if *configPath != "" {
+		relabelCfg, err = loadRelabelConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load relabeling config: %v", err)
+		}
+	}
 
 	db, err := sql.Open("postgres", config.DatabaseURL)
 	if err != nil {
@@ -302,7 +455,15 @@ func main() {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
-	http.HandleFunc("/metrics", metricsHandler(db))
+	if config.RemoteWriteURL != "" {
+		writer := newRemoteWriter(config)
+		go writer.run(db, config.RemoteWriteInterval)
+	}
+
+	collector := newCollector(db, config.ScrapeInterval)
+	go collector.run()
+
+	http.HandleFunc("/metrics", metricsHandler(collector, relabelCfg))
 
 	addr := ":" + config.Port
 	log.Printf("pmetrics Prometheus exporter listening on %s", addr)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// TestFormatMetricsIsValidPrometheusText guards against regressions where the
+// same logical labelset produces two different histogram keys (e.g. because
+// labels were iterated in a different order), which used to emit a
+// duplicated "# TYPE" line that strict parsers reject.
+func TestFormatMetricsIsValidPrometheusText(t *testing.T) {
+	metrics := []Metric{
+		{Name: "pmetrics_calls", Type: "counter", Value: 5, Labels: map[string]interface{}{"queryid": "1", "query": "select 1"}},
+		{Name: "pmetrics_calls", Type: "counter", Value: 7, Labels: map[string]interface{}{"query": "select 2", "queryid": "2"}},
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 10, Value: 3, Labels: map[string]interface{}{"queryid": "1"}},
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 50, Value: 1, Labels: map[string]interface{}{"queryid": "1"}},
+		{Name: "pmetrics_latency", Type: "histogram_sum", Value: 123, Labels: map[string]interface{}{"queryid": "1"}},
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 10, Value: 2, Labels: map[string]interface{}{"queryid": "2"}},
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 50, Value: 4, Labels: map[string]interface{}{"queryid": "2"}},
+		{Name: "pmetrics_latency", Type: "histogram_sum", Value: 456, Labels: map[string]interface{}{"queryid": "2"}},
+	}
+	allBuckets := []int{10, 50}
+
+	output := formatMetrics(metrics, allBuckets)
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader(output))
+	if err != nil {
+		t.Fatalf("expfmt failed to parse output: %v\noutput:\n%s", err, output)
+	}
+
+	if len(families) != 2 {
+		t.Fatalf("expected 2 metric families, got %d:\noutput:\n%s", len(families), output)
+	}
+
+	latency, ok := families["pmetrics_latency"]
+	if !ok {
+		t.Fatalf("expected a pmetrics_latency family, got %v", families)
+	}
+	if len(latency.Metric) != 2 {
+		t.Fatalf("expected 2 histogram series for pmetrics_latency, got %d", len(latency.Metric))
+	}
+}
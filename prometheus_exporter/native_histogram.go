@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+)
+
+const protobufContentType = `application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited`
+
+// span describes a run of contiguous native histogram buckets, matching the
+// Prometheus sparse histogram wire format: Offset is relative to the
+// previous span's end (or to zero for the first span), Length is the number
+// of buckets in the run.
+type span struct {
+	Offset int32  `json:"offset"`
+	Length uint32 `json:"length"`
+}
+
+// NativeHistogram is one labelset's worth of sparse (native) histogram data,
+// as returned by pmetrics.list_native_histograms(). Deltas are stored
+// bucket-to-bucket as the protobuf wire format expects, not as absolute
+// counts.
+type NativeHistogram struct {
+	Name           string
+	Labels         map[string]interface{}
+	Schema         int32
+	ZeroThreshold  float64
+	ZeroCount      uint64
+	PositiveSpans  []span
+	PositiveDeltas []int64
+	NegativeSpans  []span
+	NegativeDeltas []int64
+	Sum            float64
+	Count          uint64
+	CreatedAt      sql.NullFloat64
+}
+
+// fetchNativeHistograms loads native_histogram metrics. These are kept
+// separate from fetchMetrics because their shape (spans and deltas) doesn't
+// fit the one-row-per-bucket layout the fixed-bucket histograms use.
+func fetchNativeHistograms(db *sql.DB) ([]NativeHistogram, error) {
+	rows, err := db.Query(`
+		SELECT
+			name,
+			labels,
+			schema,
+			zero_threshold,
+			zero_count,
+			positive_spans,
+			positive_deltas,
+			negative_spans,
+			negative_deltas,
+			sum,
+			count,
+			created_at
+		FROM pmetrics.list_native_histograms()
+		ORDER BY name, labels::text
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch native histograms: %w", err)
+	}
+	defer rows.Close()
+
+	var result []NativeHistogram
+	for rows.Next() {
+		var h NativeHistogram
+		var labelsJSON, positiveSpansJSON, positiveDeltasJSON, negativeSpansJSON, negativeDeltasJSON []byte
+
+		if err := rows.Scan(
+			&h.Name,
+			&labelsJSON,
+			&h.Schema,
+			&h.ZeroThreshold,
+			&h.ZeroCount,
+			&positiveSpansJSON,
+			&positiveDeltasJSON,
+			&negativeSpansJSON,
+			&negativeDeltasJSON,
+			&h.Sum,
+			&h.Count,
+			&h.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan native histogram: %w", err)
+		}
+
+		if len(labelsJSON) > 0 {
+			if err := json.Unmarshal(labelsJSON, &h.Labels); err != nil {
+				return nil, fmt.Errorf("failed to parse native histogram labels: %w", err)
+			}
+		} else {
+			h.Labels = make(map[string]interface{})
+		}
+
+		if err := unmarshalIfPresent(positiveSpansJSON, &h.PositiveSpans); err != nil {
+			return nil, fmt.Errorf("failed to parse positive spans: %w", err)
+		}
+		if err := unmarshalIfPresent(positiveDeltasJSON, &h.PositiveDeltas); err != nil {
+			return nil, fmt.Errorf("failed to parse positive deltas: %w", err)
+		}
+		if err := unmarshalIfPresent(negativeSpansJSON, &h.NegativeSpans); err != nil {
+			return nil, fmt.Errorf("failed to parse negative spans: %w", err)
+		}
+		if err := unmarshalIfPresent(negativeDeltasJSON, &h.NegativeDeltas); err != nil {
+			return nil, fmt.Errorf("failed to parse negative deltas: %w", err)
+		}
+
+		result = append(result, h)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating native histograms: %w", err)
+	}
+
+	return result, nil
+}
+
+func unmarshalIfPresent(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// buildNativeHistogramFamily converts all labelsets for a single native
+// histogram metric name into one protobuf MetricFamily.
+func buildNativeHistogramFamily(name string, histograms []NativeHistogram) *dto.MetricFamily {
+	family := &dto.MetricFamily{
+		Name: proto.String(name),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+	}
+
+	for _, h := range histograms {
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: protoLabelPairs(h.Labels),
+			Histogram: &dto.Histogram{
+				SampleCount:   proto.Uint64(h.Count),
+				SampleSum:     proto.Float64(h.Sum),
+				Schema:        proto.Int32(h.Schema),
+				ZeroThreshold: proto.Float64(h.ZeroThreshold),
+				ZeroCount:     proto.Uint64(h.ZeroCount),
+				PositiveSpan:  protoSpans(h.PositiveSpans),
+				PositiveDelta: h.PositiveDeltas,
+				NegativeSpan:  protoSpans(h.NegativeSpans),
+				NegativeDelta: h.NegativeDeltas,
+			},
+		})
+	}
+
+	return family
+}
+
+func protoSpans(spans []span) []*dto.BucketSpan {
+	out := make([]*dto.BucketSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, &dto.BucketSpan{
+			Offset: proto.Int32(s.Offset),
+			Length: proto.Uint32(s.Length),
+		})
+	}
+	return out
+}
+
+func protoLabelPairs(labels map[string]interface{}) []*dto.LabelPair {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, k := range keys {
+		pairs = append(pairs, &dto.LabelPair{
+			Name:  proto.String(k),
+			Value: proto.String(fmt.Sprintf("%v", labels[k])),
+		})
+	}
+	return pairs
+}
+
+// writeProtobufMetrics renders metrics (including native histograms) as a
+// stream of length-delimited MetricFamily messages, per the Prometheus
+// protobuf exposition format.
+func writeProtobufMetrics(w io.Writer, metrics []Metric, allBuckets []int, nativeHistograms []NativeHistogram) error {
+	byName := make(map[string][]NativeHistogram)
+	var names []string
+	for _, h := range nativeHistograms {
+		if _, ok := byName[h.Name]; !ok {
+			names = append(names, h.Name)
+		}
+		byName[h.Name] = append(byName[h.Name], h)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := buildNativeHistogramFamily(name, byName[name])
+		if _, err := pbutil.WriteDelimited(w, family); err != nil {
+			return fmt.Errorf("failed to write native histogram family %s: %w", name, err)
+		}
+	}
+
+	// Classic metrics and fixed-bucket histograms are still emitted, encoded
+	// as a single MetricFamily per name built from the same per-name grouping
+	// as the text format, so protobuf scrapers see the full metric set, not just native histograms.
+	for _, family := range buildClassicMetricFamilies(metrics, allBuckets) {
+		if _, err := pbutil.WriteDelimited(w, family); err != nil {
+			return fmt.Errorf("failed to write metric family %s: %w", family.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// buildClassicMetricFamilies converts counters, gauges and fixed-bucket
+// histograms into protobuf MetricFamily messages, grouped by name via
+// groupMetricsByName just like the text and OpenMetrics exposition paths, so
+// a rename that merges two non-contiguous source metrics into one name
+// still produces a single MetricFamily.
+func buildClassicMetricFamilies(metrics []Metric, allBuckets []int) []*dto.MetricFamily {
+	groups := groupMetricsByName(metrics)
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	families := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		g := groups[name]
+
+		switch g.typ {
+		case "histogram":
+			f := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_HISTOGRAM.Enum()}
+			for _, key := range g.histLabelOrder {
+				bucketValues := g.histBuckets[key]
+
+				var cumulative uint64
+				buckets := make([]*dto.Bucket, 0, len(allBuckets))
+				for _, threshold := range allBuckets {
+					cumulative += uint64(bucketValues[threshold])
+					buckets = append(buckets, &dto.Bucket{
+						UpperBound:      proto.Float64(float64(threshold)),
+						CumulativeCount: proto.Uint64(cumulative),
+					})
+				}
+
+				f.Metric = append(f.Metric, &dto.Metric{
+					Label: protoLabelPairs(g.histLabels[key]),
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(cumulative),
+						SampleSum:   proto.Float64(float64(g.histSums[key])),
+						Bucket:      buckets,
+					},
+				})
+			}
+			families = append(families, f)
+		case "counter":
+			f := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_COUNTER.Enum()}
+			for _, key := range g.simpleLabelOrder {
+				m := g.simpleByLabel[key]
+				f.Metric = append(f.Metric, &dto.Metric{
+					Label:   protoLabelPairs(m.Labels),
+					Counter: &dto.Counter{Value: proto.Float64(float64(m.Value))},
+				})
+			}
+			families = append(families, f)
+		default:
+			f := &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum()}
+			for _, key := range g.simpleLabelOrder {
+				m := g.simpleByLabel[key]
+				f.Metric = append(f.Metric, &dto.Metric{
+					Label: protoLabelPairs(m.Labels),
+					Gauge: &dto.Gauge{Value: proto.Float64(float64(m.Value))},
+				})
+			}
+			families = append(families, f)
+		}
+	}
+
+	return families
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// negotiateFormat inspects the Accept header and returns "openmetrics" or
+// "protobuf" if the client explicitly asked for one of those exposition
+// formats, otherwise it falls back to the classic Prometheus text format
+// ("text").
+func negotiateFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "text"
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/openmetrics-text":
+			return "openmetrics"
+		case "application/vnd.google.protobuf":
+			if params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited" {
+				return "protobuf"
+			}
+		}
+	}
+
+	return "text"
+}
+
+// formatMetricsOpenMetrics converts pmetrics data to the OpenMetrics 1.0 text
+// exposition format: https://openmetrics.io/. Unlike the Prometheus text
+// format, OpenMetrics carries HELP/UNIT metadata (emitted when set) and
+// "_created" timestamps for counters and histograms (emitted when the row has
+// created_at), and terminates the payload with "# EOF". Metrics
+// are grouped by name via groupMetricsByName up front so every family's
+// samples stay contiguous and its metadata is emitted exactly once,
+// regardless of arrival order or renaming.
+func formatMetricsOpenMetrics(metrics []Metric, allBuckets []int) string {
+	var lines []string
+
+	groups := groupMetricsByName(metrics)
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		g := groups[name]
+
+		if g.typ == "histogram" {
+			emitOpenMetricsMeta(&lines, name, "histogram", g.help, g.unit)
+			for _, key := range g.histLabelOrder {
+				lines = append(lines, formatOpenMetricsHistogramSeries(name, key, g, allBuckets)...)
+			}
+			continue
+		}
+
+		emitOpenMetricsMeta(&lines, name, g.typ, g.help, g.unit)
+
+		for _, key := range g.simpleLabelOrder {
+			m := g.simpleByLabel[key]
+
+			labelStr := formatLabels(m.Labels)
+			sampleName := name
+			if m.Type == "counter" {
+				// OpenMetrics requires the Counter family name to stay bare
+				// while the point itself is suffixed "_total".
+				sampleName += "_total"
+			}
+			lines = append(lines, fmt.Sprintf("%s%s %d", sampleName, labelStr, m.Value))
+
+			if m.Type == "counter" && m.CreatedAt.Valid {
+				lines = append(lines, fmt.Sprintf("%s_created%s %g", name, labelStr, m.CreatedAt.Float64))
+			}
+		}
+	}
+
+	lines = append(lines, "# EOF")
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// emitOpenMetricsMeta appends the HELP/UNIT/TYPE lines for one metric
+// family. Called once per family since formatMetricsOpenMetrics already
+// grouped samples by name.
+func emitOpenMetricsMeta(lines *[]string, name, omType, help, unit string) {
+	if help != "" {
+		*lines = append(*lines, fmt.Sprintf("# HELP %s %s", name, help))
+	}
+	if unit != "" {
+		*lines = append(*lines, fmt.Sprintf("# UNIT %s %s", name, unit))
+	}
+	*lines = append(*lines, fmt.Sprintf("# TYPE %s %s", name, omType))
+}
+
+// formatOpenMetricsHistogramSeries renders the _bucket/_count/_sum/_created
+// series for one labelset of one histogram metric. Each finite bucket line
+// carries the first of that bucket's exemplars, if it has any; the +Inf
+// bucket carries none.
+func formatOpenMetricsHistogramSeries(name, baseLabelStr string, g *metricGroup, allBuckets []int) []string {
+	bucketValues := g.histBuckets[baseLabelStr]
+
+	var lines []string
+	var cumulativeCount int64
+	for _, bucketThreshold := range allBuckets {
+		cumulativeCount += bucketValues[bucketThreshold]
+
+		var labelStr string
+		if baseLabelStr != "" {
+			labelStr = baseLabelStr[:len(baseLabelStr)-1] + fmt.Sprintf(`,le="%d"`, bucketThreshold) + "}"
+		} else {
+			labelStr = fmt.Sprintf(`{le="%d"}`, bucketThreshold)
+		}
+
+		line := fmt.Sprintf("%s_bucket%s %d", name, labelStr, cumulativeCount)
+		if exemplars, ok := g.histExemplars[baseLabelStr][bucketThreshold]; ok && len(exemplars) > 0 {
+			line += " " + formatExemplar(exemplars[0])
+		}
+		lines = append(lines, line)
+	}
+
+	var infLabelStr string
+	if baseLabelStr != "" {
+		infLabelStr = baseLabelStr[:len(baseLabelStr)-1] + `,le="+Inf"}`
+	} else {
+		infLabelStr = `{le="+Inf"}`
+	}
+	lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, infLabelStr, cumulativeCount))
+	lines = append(lines, fmt.Sprintf("%s_count%s %d", name, baseLabelStr, cumulativeCount))
+	lines = append(lines, fmt.Sprintf("%s_sum%s %d", name, baseLabelStr, g.histSums[baseLabelStr]))
+
+	if created, ok := g.histCreated[baseLabelStr]; ok {
+		lines = append(lines, fmt.Sprintf("%s_created%s %g", name, baseLabelStr, created))
+	}
+
+	return lines
+}
+
+// formatExemplar renders an exemplar trailer as required by the OpenMetrics
+// spec: "# {labels} value timestamp". The braces are mandatory even when
+// there are no exemplar labels.
+func formatExemplar(e Exemplar) string {
+	labelStr := formatLabels(e.Labels)
+	if labelStr == "" {
+		labelStr = "{}"
+	}
+	return fmt.Sprintf("# %s %g %g", labelStr, e.Value, e.Timestamp)
+}
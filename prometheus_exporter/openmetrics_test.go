@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// TestFormatMetricsOpenMetricsHistogramMeta guards against regressions where
+// histogram HELP/UNIT metadata (including overrides applied by
+// applyRelabeling) is silently dropped.
+func TestFormatMetricsOpenMetricsHistogramMeta(t *testing.T) {
+	metrics := []Metric{
+		{
+			Name:   "pmetrics_latency",
+			Type:   "histogram",
+			Bucket: 10,
+			Value:  3,
+			Labels: map[string]interface{}{"queryid": "1"},
+			Help:   sql.NullString{String: "Query latency in seconds.", Valid: true},
+			Unit:   sql.NullString{String: "seconds", Valid: true},
+		},
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 50, Value: 1, Labels: map[string]interface{}{"queryid": "1"}},
+		{Name: "pmetrics_latency", Type: "histogram_sum", Value: 123, Labels: map[string]interface{}{"queryid": "1"}},
+	}
+
+	output := formatMetricsOpenMetrics(metrics, []int{10, 50})
+
+	if !strings.Contains(output, "# HELP pmetrics_latency Query latency in seconds.") {
+		t.Fatalf("expected HELP line for histogram, got:\n%s", output)
+	}
+	if !strings.Contains(output, "# UNIT pmetrics_latency seconds") {
+		t.Fatalf("expected UNIT line for histogram, got:\n%s", output)
+	}
+}
+
+// TestFormatMetricsOpenMetricsGroupsNonContiguousRename guards against the
+// case where applyRelabeling's Rename maps two originally distinct, non-
+// contiguous metric names onto the same target name: the OpenMetrics family
+// must still be emitted with exactly one TYPE line and all of its samples
+// together, not interleaved with an unrelated family's samples.
+func TestFormatMetricsOpenMetricsGroupsNonContiguousRename(t *testing.T) {
+	metrics := []Metric{
+		{Name: "pmetrics_calls", Type: "counter", Value: 5, Labels: map[string]interface{}{"q": "1"}},
+		{Name: "pmetrics_other", Type: "counter", Value: 9, Labels: map[string]interface{}{"q": "x"}},
+		{Name: "pmetrics_calls", Type: "counter", Value: 7, Labels: map[string]interface{}{"q": "2"}},
+	}
+
+	output := formatMetricsOpenMetrics(metrics, nil)
+
+	if strings.Count(output, "# TYPE pmetrics_calls") != 1 {
+		t.Fatalf("expected exactly one TYPE line for pmetrics_calls, got:\n%s", output)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	first, last, count := -1, -1, 0
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "pmetrics_calls_total") {
+			continue
+		}
+		if first == -1 {
+			first = i
+		}
+		last = i
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 pmetrics_calls_total samples, got %d:\n%s", count, output)
+	}
+	if last-first+1 != count {
+		t.Fatalf("expected pmetrics_calls_total samples to stay contiguous, got:\n%s", output)
+	}
+}
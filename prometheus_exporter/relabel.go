@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RelabelConfig is the user-facing shape of the --config file: it lets
+// operators rename metrics coming out of pmetrics.list_metrics(), drop
+// labels, rewrite label values, add static labels, and filter which metrics
+// get exposed at all, modeled after the MetricMap/LabelMap pattern from
+// postgres_exporter.
+type RelabelConfig struct {
+	Rename             map[string]string         `yaml:"rename" json:"rename"`
+	DropLabels         []string                  `yaml:"drop_labels" json:"drop_labels"`
+	LabelValueRewrites []LabelValueRewrite       `yaml:"label_value_rewrites" json:"label_value_rewrites"`
+	StaticLabels       map[string]string         `yaml:"static_labels" json:"static_labels"`
+	MetricOverrides    map[string]MetricOverride `yaml:"metric_overrides" json:"metric_overrides"`
+	Allow              []string                  `yaml:"allow" json:"allow"`
+	Deny               []string                  `yaml:"deny" json:"deny"`
+}
+
+// LabelValueRewrite rewrites every value of Label matching Regex to
+// Replacement (using regexp.ReplaceAllString semantics, so $1-style capture
+// group references are supported).
+type LabelValueRewrite struct {
+	Label       string `yaml:"label" json:"label"`
+	Regex       string `yaml:"regex" json:"regex"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+}
+
+// MetricOverride lets a metric's HELP/UNIT be set from the config file
+// instead of requiring a SQL-side change.
+type MetricOverride struct {
+	Help string `yaml:"help" json:"help"`
+	Unit string `yaml:"unit" json:"unit"`
+}
+
+// compiledRelabelConfig is RelabelConfig with its regexes pre-compiled, built
+// once at startup so every scrape doesn't pay regex compilation cost.
+type compiledRelabelConfig struct {
+	raw                *RelabelConfig
+	labelValueRewrites []compiledLabelValueRewrite
+	allow              []*regexp.Regexp
+	deny               []*regexp.Regexp
+}
+
+type compiledLabelValueRewrite struct {
+	label       string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// loadRelabelConfig reads and compiles the --config file. YAML is assumed
+// unless the path ends in .json.
+func loadRelabelConfig(path string) (*compiledRelabelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg RelabelConfig
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file as JSON: %w", err)
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file as YAML: %w", err)
+		}
+	}
+
+	return compileRelabelConfig(&cfg)
+}
+
+func compileRelabelConfig(cfg *RelabelConfig) (*compiledRelabelConfig, error) {
+	compiled := &compiledRelabelConfig{raw: cfg}
+
+	for _, rewrite := range cfg.LabelValueRewrites {
+		re, err := regexp.Compile(rewrite.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label_value_rewrites regex %q for label %q: %w", rewrite.Regex, rewrite.Label, err)
+		}
+		compiled.labelValueRewrites = append(compiled.labelValueRewrites, compiledLabelValueRewrite{
+			label:       rewrite.Label,
+			regex:       re,
+			replacement: rewrite.Replacement,
+		})
+	}
+
+	for _, pattern := range cfg.Allow {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow regex %q: %w", pattern, err)
+		}
+		compiled.allow = append(compiled.allow, re)
+	}
+
+	for _, pattern := range cfg.Deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny regex %q: %w", pattern, err)
+		}
+		compiled.deny = append(compiled.deny, re)
+	}
+
+	return compiled, nil
+}
+
+// applyRelabeling runs metrics through the configured transformation pass:
+// deny/allow filtering, then per-metric help/unit overrides, label drops,
+// label value rewrites, static labels, and finally renaming. Order matters:
+// the allow/deny filter and the overrides are keyed by the metric's original
+// name, so config files don't have to account for the rename when writing
+// them. Label drops, rewrites and static labels apply to every metric.
+func applyRelabeling(metrics []Metric, cfg *compiledRelabelConfig) []Metric {
+	if cfg == nil {
+		return metrics
+	}
+
+	filtered := metrics[:0:0]
+	for _, m := range metrics {
+		if !relabelingAllows(cfg, m.Name) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+
+	result := make([]Metric, len(filtered))
+	for i, m := range filtered {
+		if override, ok := cfg.raw.MetricOverrides[m.Name]; ok {
+			if override.Help != "" {
+				m.Help = sql.NullString{String: override.Help, Valid: true}
+			}
+			if override.Unit != "" {
+				m.Unit = sql.NullString{String: override.Unit, Valid: true}
+			}
+		}
+
+		if len(m.Labels) > 0 {
+			labels := make(map[string]interface{}, len(m.Labels))
+			for k, v := range m.Labels {
+				labels[k] = v
+			}
+			for _, drop := range cfg.raw.DropLabels {
+				delete(labels, drop)
+			}
+			for _, rewrite := range cfg.labelValueRewrites {
+				v, ok := labels[rewrite.label]
+				if !ok {
+					continue
+				}
+				labels[rewrite.label] = rewrite.regex.ReplaceAllString(fmt.Sprintf("%v", v), rewrite.replacement)
+			}
+			for k, v := range cfg.raw.StaticLabels {
+				labels[k] = v
+			}
+			m.Labels = labels
+		} else if len(cfg.raw.StaticLabels) > 0 {
+			labels := make(map[string]interface{}, len(cfg.raw.StaticLabels))
+			for k, v := range cfg.raw.StaticLabels {
+				labels[k] = v
+			}
+			m.Labels = labels
+		}
+
+		if renamed, ok := cfg.raw.Rename[m.Name]; ok {
+			m.Name = renamed
+		}
+
+		result[i] = m
+	}
+
+	return result
+}
+
+func relabelingAllows(cfg *compiledRelabelConfig, name string) bool {
+	for _, re := range cfg.deny {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(cfg.allow) == 0 {
+		return true
+	}
+	for _, re := range cfg.allow {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMetricOverrideAppliesToHistogramOpenMetricsMeta guards against
+// regressions where a metric_overrides help/unit override, applied by
+// applyRelabeling, had no visible effect on a histogram because the
+// OpenMetrics HELP/UNIT emission for histograms was broken independently of
+// relabeling.
+func TestMetricOverrideAppliesToHistogramOpenMetricsMeta(t *testing.T) {
+	cfg, err := compileRelabelConfig(&RelabelConfig{
+		MetricOverrides: map[string]MetricOverride{
+			"pmetrics_latency": {Help: "Overridden help text.", Unit: "seconds"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileRelabelConfig: %v", err)
+	}
+
+	metrics := []Metric{
+		{Name: "pmetrics_latency", Type: "histogram", Bucket: 10, Value: 3, Labels: map[string]interface{}{"queryid": "1"}},
+		{Name: "pmetrics_latency", Type: "histogram_sum", Value: 123, Labels: map[string]interface{}{"queryid": "1"}},
+	}
+
+	relabeled := applyRelabeling(metrics, cfg)
+	output := formatMetricsOpenMetrics(relabeled, []int{10})
+
+	if !strings.Contains(output, "# HELP pmetrics_latency Overridden help text.") {
+		t.Fatalf("expected overridden HELP to reach histogram output, got:\n%s", output)
+	}
+	if !strings.Contains(output, "# UNIT pmetrics_latency seconds") {
+		t.Fatalf("expected overridden UNIT to reach histogram output, got:\n%s", output)
+	}
+}
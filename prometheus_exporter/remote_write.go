@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	remoteWriteQueueCapacity  = 16
+	remoteWriteMaxAttempts    = 5
+	remoteWriteInitialBackoff = 1 * time.Second
+	remoteWriteMaxBackoff     = 30 * time.Second
+)
+
+// RemoteWriter periodically scrapes pmetrics and pushes the result to a
+// Prometheus remote-write endpoint, for deployments where a Prometheus
+// scraper can't reliably discover a short-lived Postgres sidecar.
+type RemoteWriter struct {
+	url         string
+	client      *http.Client
+	username    string
+	password    string
+	bearerToken string
+	queue       chan []byte
+}
+
+func newRemoteWriter(cfg *Config) *RemoteWriter {
+	return &RemoteWriter{
+		url:         cfg.RemoteWriteURL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		username:    cfg.RemoteWriteUsername,
+		password:    cfg.RemoteWritePassword,
+		bearerToken: cfg.RemoteWriteBearerToken,
+		queue:       make(chan []byte, remoteWriteQueueCapacity),
+	}
+}
+
+// run scrapes on the given interval and feeds the queue. It owns the
+// ticker loop, so it blocks until the process exits; the caller starts it
+// with "go writer.run(...)" and lets drainQueue handle delivery separately.
+func (w *RemoteWriter) run(db *sql.DB, interval time.Duration) {
+	go w.drainQueue()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		metrics, allBuckets, err := fetchMetrics(db)
+		if err != nil {
+			log.Printf("remote_write: failed to fetch metrics: %v", err)
+			continue
+		}
+
+		body, err := buildWriteRequestBody(metrics, allBuckets)
+		if err != nil {
+			log.Printf("remote_write: failed to build write request: %v", err)
+			continue
+		}
+
+		w.enqueue(body)
+	}
+}
+
+// enqueue drops the oldest queued batch to make room when the queue is full,
+// so a slow or down receiver can't grow memory usage without bound.
+func (w *RemoteWriter) enqueue(body []byte) {
+	select {
+	case w.queue <- body:
+		return
+	default:
+	}
+
+	select {
+	case <-w.queue:
+		log.Printf("remote_write: queue full, dropped oldest batch")
+	default:
+	}
+
+	select {
+	case w.queue <- body:
+	default:
+	}
+}
+
+func (w *RemoteWriter) drainQueue() {
+	for body := range w.queue {
+		w.sendWithRetry(body)
+	}
+}
+
+func (w *RemoteWriter) sendWithRetry(body []byte) {
+	backoff := remoteWriteInitialBackoff
+
+	for attempt := 1; attempt <= remoteWriteMaxAttempts; attempt++ {
+		status, err := w.send(body)
+		if err == nil && status < 500 {
+			if status >= 400 {
+				log.Printf("remote_write: receiver rejected batch with status %d, dropping", status)
+			}
+			return
+		}
+
+		if err != nil {
+			log.Printf("remote_write: send failed (attempt %d/%d): %v", attempt, remoteWriteMaxAttempts, err)
+		} else {
+			log.Printf("remote_write: receiver returned %d (attempt %d/%d), retrying", status, attempt, remoteWriteMaxAttempts)
+		}
+
+		if attempt == remoteWriteMaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+
+	log.Printf("remote_write: giving up on batch after %d attempts", remoteWriteMaxAttempts)
+}
+
+func (w *RemoteWriter) send(body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+// buildWriteRequestBody converts metrics into a prompb.WriteRequest, encodes
+// it and applies Snappy framing as required by the remote-write protocol.
+func buildWriteRequestBody(metrics []Metric, allBuckets []int) ([]byte, error) {
+	req := &prompb.WriteRequest{
+		Timeseries: timeSeriesFromMetrics(metrics, allBuckets),
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(nil, data), nil
+}
+
+// timeSeriesFromMetrics expands simple metrics and cumulative histograms
+// into remote-write TimeSeries, stamping every sample with the current time
+// since remote-write, unlike a pull scrape, has no receiver-assigned
+// timestamp to attach instead. Metrics are grouped by name via
+// groupMetricsByName so a rename that merges two distinct source metrics
+// into one target name can't produce two TimeSeries with identical labels in
+// the same WriteRequest.
+func timeSeriesFromMetrics(metrics []Metric, allBuckets []int) []prompb.TimeSeries {
+	now := time.Now().UnixMilli()
+
+	groups := groupMetricsByName(metrics)
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var series []prompb.TimeSeries
+
+	for _, name := range names {
+		g := groups[name]
+
+		if g.typ == "histogram" {
+			for _, key := range g.histLabelOrder {
+				labels := g.histLabels[key]
+				bucketValues := g.histBuckets[key]
+
+				var cumulative int64
+				for _, threshold := range allBuckets {
+					cumulative += bucketValues[threshold]
+					extra := map[string]string{"le": formatBucketBound(threshold)}
+					series = append(series, remoteWriteSeries(name+"_bucket", labels, extra, float64(cumulative), now))
+				}
+				series = append(series, remoteWriteSeries(name+"_bucket", labels, map[string]string{"le": "+Inf"}, float64(cumulative), now))
+				series = append(series, remoteWriteSeries(name+"_count", labels, nil, float64(cumulative), now))
+				series = append(series, remoteWriteSeries(name+"_sum", labels, nil, float64(g.histSums[key]), now))
+			}
+			continue
+		}
+
+		for _, key := range g.simpleLabelOrder {
+			m := g.simpleByLabel[key]
+			series = append(series, remoteWriteSeries(name, m.Labels, nil, float64(m.Value), now))
+		}
+	}
+
+	return series
+}
+
+func formatBucketBound(threshold int) string {
+	return fmt.Sprintf("%d", threshold)
+}
+
+func remoteWriteSeries(name string, labels map[string]interface{}, extra map[string]string, value float64, timestampMs int64) prompb.TimeSeries {
+	keys := make([]string, 0, len(labels)+len(extra)+1)
+	keys = append(keys, "__name__")
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	labelPairs := make([]prompb.Label, 0, len(keys))
+	for _, k := range keys {
+		var v string
+		switch k {
+		case "__name__":
+			v = name
+		default:
+			if ev, ok := extra[k]; ok {
+				v = ev
+			} else {
+				v = fmt.Sprintf("%v", labels[k])
+			}
+		}
+		labelPairs = append(labelPairs, prompb.Label{Name: k, Value: v})
+	}
+
+	return prompb.TimeSeries{
+		Labels:  labelPairs,
+		Samples: []prompb.Sample{{Value: value, Timestamp: timestampMs}},
+	}
+}
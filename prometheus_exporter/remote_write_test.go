@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+// TestTimeSeriesFromMetricsDedupesRenamedCollisions guards against the case
+// where applyRelabeling's Rename maps two originally distinct metrics onto
+// the same name and labelset: remote-write rejects a WriteRequest containing
+// two TimeSeries with identical labels, so they must collapse to one series
+// instead of being emitted as arrival-order duplicates.
+func TestTimeSeriesFromMetricsDedupesRenamedCollisions(t *testing.T) {
+	metrics := []Metric{
+		{Name: "pmetrics_calls", Type: "counter", Value: 5, Labels: map[string]interface{}{"q": "1"}},
+		{Name: "pmetrics_other", Type: "gauge", Value: 1, Labels: nil},
+		{Name: "pmetrics_calls", Type: "counter", Value: 9, Labels: map[string]interface{}{"q": "1"}},
+	}
+
+	series := timeSeriesFromMetrics(metrics, nil)
+
+	count := 0
+	for _, s := range series {
+		for _, l := range s.Labels {
+			if l.Name == "__name__" && l.Value == "pmetrics_calls" {
+				count++
+			}
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected exactly 1 pmetrics_calls series after dedup, got %d", count)
+	}
+}